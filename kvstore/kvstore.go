@@ -0,0 +1,81 @@
+// Copyright 2018 The Redix Authors. All rights reserved.
+// Use of this source code is governed by a Apache 2.0
+// license that can be found in the LICENSE file.
+//
+// kvstore defines the storage engine contract shared by ram, bolt, etc.
+
+package kvstore
+
+// Store - the interface every storage engine (ram, bolt, ...) must implement
+type Store interface {
+	// Size - returns the size of the database
+	Size() int64
+
+	// GC - runs the garbage collector
+	GC() error
+
+	// Close - releases any resources (background goroutines, file handles, ...)
+	// held by the engine, callers (e.g. an engine registry) should call this
+	// on process exit
+	Close() error
+
+	// Incr - increment the key by the specified value
+	Incr(k string, by int64) (int64, error)
+
+	// Set - sets a key with the specified value and optional ttl
+	Set(k, v string, ttl int) error
+
+	// SetNX - sets k only if it doesn't already exist (or has already expired)
+	SetNX(k, v string, ttl int) (bool, error)
+
+	// SetXX - sets k only if it already exists and hasn't expired
+	SetXX(k, v string, ttl int) (bool, error)
+
+	// CAS - atomically replaces k's value with newVal if its current value is old
+	CAS(k, old, newVal string, ttl int) (bool, error)
+
+	// GetSet - atomically swaps k's value for v and returns the previous value
+	GetSet(k, v string, ttl int) (string, error)
+
+	// MSet - sets multiple key-value pairs
+	MSet(data map[string]string) error
+
+	// Get - fetches the value of the specified k
+	Get(k string) (string, error)
+
+	// MGet - fetch multiple values of the specified keys
+	MGet(keys []string) []string
+
+	// TTL - returns the time to live of the specified key's value
+	TTL(key string) int64
+
+	// Expire - updates the TTL of an existing, non-expired key
+	Expire(key string, ttl int) (bool, error)
+
+	// ExpireAt - same as Expire but takes an absolute unix timestamp (in seconds)
+	ExpireAt(key string, unixSeconds int64) (bool, error)
+
+	// Persist - removes the TTL of a key, making it live forever
+	Persist(key string) (bool, error)
+
+	// Del - removes key(s) from the store
+	Del(keys []string) error
+
+	// Scan - iterate over the whole store using the handler function
+	Scan(scannerOpt ScannerOptions) error
+}
+
+// ScannerOptions - options controlling Scan's iteration over a Store's keyspace
+type ScannerOptions struct {
+	// Prefix - only keys starting with Prefix are visited
+	Prefix string
+
+	// Offset - resume scanning strictly after this key, empty starts from the beginning
+	Offset string
+
+	// FetchValues - when true, the handler receives each key's value, otherwise v is empty
+	FetchValues bool
+
+	// Handler - invoked as (k, v), iteration stops when it returns false
+	Handler func(k, v string) bool
+}
@@ -9,37 +9,210 @@ package ram
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alash3al/redix/kvstore"
 )
 
+// defaultShardCount - number of shards used when RamOptions.ShardCount is
+// left unset
+const defaultShardCount = 256
+
+// item - a stored value plus its absolute expiry, exp == 0 means no TTL
+type item struct {
+	exp uint32
+	val string
+}
+
+// shard - one bucket of the keyspace, guarded independently so writers to
+// different shards never block each other
+type shard struct {
+	mu sync.RWMutex
+	m  map[string]item
+}
+
+// RamOptions - tunables for OpenRam, all optional
+type RamOptions struct {
+	// ReaperInterval - how often the background reaper sweeps for expired keys,
+	// the reaper is disabled when this is <= 0
+	ReaperInterval time.Duration
+
+	// ReaperBatch - max number of expired keys collected per shard per sweep,
+	// defaults to 1000 when <= 0
+	ReaperBatch int
+
+	// ShardCount - number of shards the keyspace is split across, defaults to
+	// 256 when <= 0
+	ShardCount int
+}
+
+// compile-time assertion that RamDB satisfies kvstore.Store, so an engine
+// registry can hold it as a kvstore.Store and call Close() on shutdown
+var _ kvstore.Store = (*RamDB)(nil)
+
 // RamDB - represents a ram db implementation
 type RamDB struct {
-	ram           *sync.Map
-	countersLocks sync.RWMutex
+	shards    []*shard
+	opts      RamOptions
+	nowSec    uint32
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // OpenRam - Opens the specified path
-func OpenRam(path string) (*RamDB, error) {
+func OpenRam(path string, opts ...RamOptions) (*RamDB, error) {
 	db := new(RamDB)
-	db.ram = &sync.Map{}
-	db.countersLocks = sync.RWMutex{}
+	db.closeCh = make(chan struct{})
+
+	if len(opts) > 0 {
+		db.opts = opts[0]
+	}
+
+	shardCount := db.opts.ShardCount
+	if shardCount <= 0 {
+		shardCount = defaultShardCount
+	}
+
+	db.shards = make([]*shard, shardCount)
+	for i := range db.shards {
+		db.shards[i] = &shard{m: make(map[string]item)}
+	}
+
+	db.nowSec = uint32(time.Now().Unix())
+
+	db.wg.Add(1)
+	go db.tickNow()
+
+	if db.opts.ReaperInterval > 0 {
+		db.wg.Add(1)
+		go db.reap()
+	}
 
 	return db, nil
 }
 
+// Close - stops the background clock and reaper (if any) and drains them
+func (db *RamDB) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.closeCh)
+	})
+
+	db.wg.Wait()
+
+	return nil
+}
+
+// now - returns the cached current unix second, refreshed once per second by
+// tickNow so hot paths avoid a time.Now() syscall per op
+func (db *RamDB) now() uint32 {
+	return atomic.LoadUint32(&db.nowSec)
+}
+
+// tickNow - keeps nowSec fresh for the lifetime of the db
+func (db *RamDB) tickNow() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			atomic.StoreUint32(&db.nowSec, uint32(time.Now().Unix()))
+		}
+	}
+}
+
+// shardFor - picks the shard that owns k
+func (db *RamDB) shardFor(k string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+
+	return db.shards[h.Sum32()%uint32(len(db.shards))]
+}
+
+// reap - wakes up on a ticker and expires keys whose TTL has passed, it never
+// holds a shard's lock across more than one shard at a time
+func (db *RamDB) reap() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.opts.ReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			db.reapExpired()
+		}
+	}
+}
+
+// reapExpired - collects a batch of expired keys per shard via a read-locked
+// scan, then re-checks and deletes them under that shard's write lock.
+//
+// Note: the original (chunk0-1) reaper re-checked the expiry against a
+// sync.Map snapshot but then called sync.Map.Delete unconditionally, which
+// has no compare-and-delete and so could still clobber a Set that renewed
+// the TTL between the check and the delete. That race is only actually
+// closed here, by re-checking sh.m[k] under the shard's write lock below.
+func (db *RamDB) reapExpired() {
+	batch := db.opts.ReaperBatch
+	if batch <= 0 {
+		batch = 1000
+	}
+
+	now := db.now()
+
+	for _, sh := range db.shards {
+		expired := make([]string, 0, batch)
+
+		sh.mu.RLock()
+		for k, it := range sh.m {
+			if it.exp > 0 && it.exp <= now {
+				expired = append(expired, k)
+				if len(expired) >= batch {
+					break
+				}
+			}
+		}
+		sh.mu.RUnlock()
+
+		if len(expired) == 0 {
+			continue
+		}
+
+		sh.mu.Lock()
+		for _, k := range expired {
+			if it, ok := sh.m[k]; ok && it.exp > 0 && it.exp <= db.now() {
+				delete(sh.m, k)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
 // Size - returns the size of the database
 func (db *RamDB) Size() int64 {
 	count := int64(0)
 
-	db.ram.Range(func(key, value interface{}) bool {
-		count += int64(len(key.(string)) + len(value.(string)))
-		return true
-	})
+	for _, sh := range db.shards {
+		sh.mu.RLock()
+		for k, it := range sh.m {
+			count += int64(len(k) + len(it.val))
+		}
+		sh.mu.RUnlock()
+	}
 
 	return count
 }
@@ -51,33 +224,206 @@ func (db *RamDB) GC() error {
 
 // Incr - increment the key by the specified value
 func (db *RamDB) Incr(k string, by int64) (int64, error) {
-	db.countersLocks.Lock()
-	defer db.countersLocks.Unlock()
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var valInt int64
+
+	if it, ok := sh.m[k]; ok && !(it.exp > 0 && db.now() >= it.exp) {
+		valInt, _ = strconv.ParseInt(it.val, 10, 64)
+	}
 
-	val, _ := db.Get(k)
-	valInt, _ := strconv.ParseInt(val, 10, 64)
 	valInt += by
 
-	db.Set(k, strconv.FormatInt(valInt, 10), -1)
+	sh.m[k] = item{val: strconv.FormatInt(valInt, 10)}
 
 	return valInt, nil
 }
 
 // Set - sets a key with the specified value and optional ttl
 func (db *RamDB) Set(k, v string, ttl int) error {
-	var expires int64
+	var exp uint32
 
 	if ttl > 0 {
-		expires = time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix()
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
 	}
 
-	v = strconv.Itoa(int(expires)) + ";" + v
+	sh := db.shardFor(k)
 
-	db.ram.Store(k, v)
+	sh.mu.Lock()
+	sh.m[k] = item{exp: exp, val: v}
+	sh.mu.Unlock()
 
 	return nil
 }
 
+// SetNX - sets k only if it doesn't already exist (or has already expired)
+func (db *RamDB) SetNX(k, v string, ttl int) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if it, ok := sh.m[k]; ok && !(it.exp > 0 && db.now() >= it.exp) {
+		return false, nil
+	}
+
+	var exp uint32
+	if ttl > 0 {
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
+	}
+
+	sh.m[k] = item{exp: exp, val: v}
+
+	return true, nil
+}
+
+// SetXX - sets k only if it already exists and hasn't expired
+func (db *RamDB) SetXX(k, v string, ttl int) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	it, ok := sh.m[k]
+	if !ok || (it.exp > 0 && db.now() >= it.exp) {
+		return false, nil
+	}
+
+	var exp uint32
+	if ttl > 0 {
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
+	}
+
+	sh.m[k] = item{exp: exp, val: v}
+
+	return true, nil
+}
+
+// CAS - atomically replaces k's value with newVal if its current value is
+// old, returns false if k doesn't exist, has expired, or holds a different
+// value
+func (db *RamDB) CAS(k, old, newVal string, ttl int) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	it, ok := sh.m[k]
+	if !ok || (it.exp > 0 && db.now() >= it.exp) || it.val != old {
+		return false, nil
+	}
+
+	var exp uint32
+	if ttl > 0 {
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
+	}
+
+	sh.m[k] = item{exp: exp, val: newVal}
+
+	return true, nil
+}
+
+// GetSet - atomically swaps k's value for v (creating it if missing or
+// expired) and returns the value that was previously stored
+func (db *RamDB) GetSet(k, v string, ttl int) (string, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var old string
+	if it, ok := sh.m[k]; ok && !(it.exp > 0 && db.now() >= it.exp) {
+		old = it.val
+	}
+
+	var exp uint32
+	if ttl > 0 {
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
+	}
+
+	sh.m[k] = item{exp: exp, val: v}
+
+	return old, nil
+}
+
+// Expire - updates the TTL of an existing, non-expired key in place. ttl is
+// accepted in milliseconds for symmetry with Set, but expiries are stored
+// with one-second resolution (uint32 unix seconds, like the rest of this
+// file), so a ttl under ~1000ms rounds down to "now" and the key reads back
+// as already expired. Returns false if the key does not exist or is already
+// expired.
+func (db *RamDB) Expire(k string, ttl int) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	it, ok := sh.m[k]
+	if !ok || (it.exp > 0 && db.now() >= it.exp) {
+		return false, nil
+	}
+
+	var exp uint32
+	if ttl > 0 {
+		exp = uint32(time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix())
+	}
+
+	sh.m[k] = item{exp: exp, val: it.val}
+
+	return true, nil
+}
+
+// ExpireAt - same as Expire but takes an absolute unix timestamp (in
+// seconds), a timestamp that is already in the past deletes k immediately
+// (mirroring Redis EXPIREAT) rather than being stored into the exp == 0 "no
+// TTL" sentinel; a subsequent Get(k) then reports "Key Not Found" like any
+// other deleted key, not the lazy-expiry "-2"
+func (db *RamDB) ExpireAt(k string, unixSeconds int64) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	it, ok := sh.m[k]
+	if !ok || (it.exp > 0 && db.now() >= it.exp) {
+		return false, nil
+	}
+
+	if unixSeconds <= int64(db.now()) {
+		delete(sh.m, k)
+		return true, nil
+	}
+
+	sh.m[k] = item{exp: uint32(unixSeconds), val: it.val}
+
+	return true, nil
+}
+
+// Persist - removes the TTL of a key making it live forever, returns false if
+// the key does not exist, is already expired, or has no TTL to remove
+func (db *RamDB) Persist(k string) (bool, error) {
+	sh := db.shardFor(k)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	it, ok := sh.m[k]
+	if !ok || (it.exp > 0 && db.now() >= it.exp) {
+		return false, nil
+	}
+
+	if it.exp == 0 {
+		return false, nil
+	}
+
+	sh.m[k] = item{val: it.val}
+
+	return true, nil
+}
+
 // MSet - sets multiple key-value pairs
 func (db *RamDB) MSet(data map[string]string) error {
 
@@ -90,32 +436,27 @@ func (db *RamDB) MSet(data map[string]string) error {
 
 // Get - fetches the value of the specified k
 func (db *RamDB) Get(k string) (string, error) {
+	sh := db.shardFor(k)
 
-	var delKeys []string
-	delete := false
-
-	data, ok := db.ram.Load(k)
+	sh.mu.RLock()
+	it, ok := sh.m[k]
+	sh.mu.RUnlock()
 
 	if !ok {
 		return "", errors.New("Key Not Found")
 	}
 
-	parts := strings.SplitN(data.(string), ";", 2)
-
-	expires, actual := parts[0], parts[1]
-
-	if exp, _ := strconv.Atoi(expires); exp > 0 && int(time.Now().Unix()) >= exp {
-		delete = true
-	}
-
-	if delete {
-		delKeys = append(delKeys, k)
-		db.Del(delKeys)
+	if it.exp > 0 && db.now() >= it.exp {
+		sh.mu.Lock()
+		if cur, ok := sh.m[k]; ok && cur.exp > 0 && db.now() >= cur.exp {
+			delete(sh.m, k)
+		}
+		sh.mu.Unlock()
 
 		return "-2", nil
 	}
 
-	return actual, nil
+	return it.val, nil
 }
 
 // MGet - fetch multiple values of the specified keys
@@ -134,29 +475,22 @@ func (db *RamDB) MGet(keys []string) (data []string) {
 
 // TTL - returns the time to live of the specified key's value
 func (db *RamDB) TTL(key string) int64 {
-	val, ok := db.ram.Load(key)
+	sh := db.shardFor(key)
 
-	if !ok {
-		return -2
-	}
+	sh.mu.RLock()
+	it, ok := sh.m[key]
+	sh.mu.RUnlock()
 
-	if val == nil {
+	if !ok {
 		return -2
 	}
 
-	parts := strings.SplitN(val.(string), ";", 2)
-
-	exp, _ := strconv.Atoi(parts[0])
-	expires := int64(exp)
-	now := time.Now().Unix()
-
-	if expires == 0 {
+	if it.exp == 0 {
 		return -1
 	}
 
-	if expires == -1 {
-		return -1
-	}
+	now := int64(db.now())
+	expires := int64(it.exp)
 
 	if now >= expires {
 		return -2
@@ -169,14 +503,64 @@ func (db *RamDB) TTL(key string) int64 {
 func (db *RamDB) Del(keys []string) error {
 
 	for _, k := range keys {
-		db.ram.Delete(k)
+		sh := db.shardFor(k)
+
+		sh.mu.Lock()
+		delete(sh.m, k)
+		sh.mu.Unlock()
 	}
 
 	return nil
 }
 
-// Scan - iterate over the whole store using the handler function
+// Scan - iterate over the whole store using the handler function, results are
+// sorted lexicographically so a scan can be resumed from the last key seen by
+// passing it back as scannerOpt.Offset
 func (db *RamDB) Scan(scannerOpt kvstore.ScannerOptions) error {
+	now := db.now()
+
+	var keys []string
+	var expired []string
+
+	for _, sh := range db.shards {
+		sh.mu.RLock()
+		for k, it := range sh.m {
+			if scannerOpt.Prefix != "" && !strings.HasPrefix(k, scannerOpt.Prefix) {
+				continue
+			}
+
+			if it.exp > 0 && it.exp <= now {
+				expired = append(expired, k)
+				continue
+			}
+
+			keys = append(keys, k)
+		}
+		sh.mu.RUnlock()
+	}
+
+	if len(expired) > 0 {
+		db.Del(expired)
+	}
+
+	sort.Strings(keys)
+
+	start := 0
+	if scannerOpt.Offset != "" {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > scannerOpt.Offset })
+	}
+
+	for _, k := range keys[start:] {
+		var v string
+
+		if scannerOpt.FetchValues {
+			v, _ = db.Get(k)
+		}
+
+		if !scannerOpt.Handler(k, v) {
+			break
+		}
+	}
 
 	return nil
 }
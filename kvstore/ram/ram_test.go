@@ -0,0 +1,407 @@
+// Copyright 2018 The Redix Authors. All rights reserved.
+// Use of this source code is governed by a Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ram
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alash3al/redix/kvstore"
+)
+
+func TestRamDB_ReaperExpiresWithoutGet(t *testing.T) {
+	db, err := OpenRam("", RamOptions{
+		ReaperInterval: 10 * time.Millisecond,
+		ReaperBatch:    1000,
+	})
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	const total = 5000
+
+	for i := 0; i < total; i++ {
+		if err := db.Set("key:"+strconv.Itoa(i), "v", 10); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	if size := db.Size(); size == 0 {
+		t.Fatalf("Size() = 0 before the keys had a chance to expire")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.Size() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if size := db.Size(); size != 0 {
+		t.Fatalf("Size() = %d, want 0 after the reaper sweeps expired keys", size)
+	}
+}
+
+func TestRamDB_Expire(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if ok, err := db.Expire("missing", 1000); err != nil || ok {
+		t.Fatalf("Expire() = %v, %v for a key that doesn't exist, want false, nil", ok, err)
+	}
+
+	if err := db.Set("k", "v", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// exp is stored with one-second resolution, so the ttl needs to clear a
+	// full second boundary for TTL() to observe the key as still live
+	if ok, err := db.Expire("k", 2000); err != nil || !ok {
+		t.Fatalf("Expire() = %v, %v, want true, nil", ok, err)
+	}
+
+	if ttl := db.TTL("k"); ttl <= 0 {
+		t.Fatalf("TTL() = %d after Expire(), want > 0", ttl)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	if v, _ := db.Get("k"); v != "-2" {
+		t.Fatalf("Get() = %q after Expire() TTL elapsed, want -2", v)
+	}
+}
+
+func TestRamDB_ExpireAt(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Set("k", "v", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute).Unix()
+
+	if ok, err := db.ExpireAt("k", past); err != nil || !ok {
+		t.Fatalf("ExpireAt() = %v, %v, want true, nil", ok, err)
+	}
+
+	if v, err := db.Get("k"); err == nil {
+		t.Fatalf("Get() = %q, nil after ExpireAt() in the past, want a Key Not Found error", v)
+	}
+}
+
+func TestRamDB_ExpireAtZeroDeletesImmediately(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Set("k", "v", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if ok, err := db.ExpireAt("k", 0); err != nil || !ok {
+		t.Fatalf("ExpireAt() = %v, %v, want true, nil", ok, err)
+	}
+
+	if v, err := db.Get("k"); err == nil {
+		t.Fatalf("Get() = %q, nil after ExpireAt(k, 0), want a Key Not Found error (deleted, not made immortal)", v)
+	}
+}
+
+func TestRamDB_Persist(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Set("k", "v", 60000); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if ok, err := db.Persist("k"); err != nil || !ok {
+		t.Fatalf("Persist() = %v, %v, want true, nil", ok, err)
+	}
+
+	if ttl := db.TTL("k"); ttl != -1 {
+		t.Fatalf("TTL() = %d after Persist(), want -1", ttl)
+	}
+
+	if ok, _ := db.Persist("k"); ok {
+		t.Fatalf("Persist() = true for a key that already has no TTL")
+	}
+}
+
+func TestRamDB_CloseStopsReaper(t *testing.T) {
+	db, err := OpenRam("", RamOptions{ReaperInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		db.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a second Close() did not return on an already-closed db")
+	}
+}
+
+func TestRamDB_ScanPrefixAndResume(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	const total = 100000
+
+	for i := 0; i < total; i++ {
+		k := "user:" + strconv.Itoa(i)
+
+		ttl := -1
+		if i%10 == 0 {
+			ttl = 1 // already expired by the time Scan runs
+		}
+
+		if err := db.Set(k, "v", ttl); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	if err := db.Set("other:1", "v", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// Scan reads the cached clock, which is refreshed only once per second, so
+	// wait past a refresh for the 1ms TTLs above to read as expired
+	time.Sleep(1100 * time.Millisecond)
+
+	var all []string
+
+	err = db.Scan(kvstore.ScannerOptions{
+		Prefix: "user:",
+		Handler: func(k, v string) bool {
+			all = append(all, k)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	want := total - total/10
+	if len(all) != want {
+		t.Fatalf("Scan() returned %d keys, want %d", len(all), want)
+	}
+
+	for i, k := range all {
+		if i > 0 && k <= all[i-1] {
+			t.Fatalf("Scan() results not sorted at index %d: %q <= %q", i, k, all[i-1])
+		}
+	}
+
+	mid := len(all) / 2
+	offset := all[mid-1]
+
+	var resumed []string
+
+	err = db.Scan(kvstore.ScannerOptions{
+		Prefix: "user:",
+		Offset: offset,
+		Handler: func(k, v string) bool {
+			resumed = append(resumed, k)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	if len(resumed) != len(all)-mid {
+		t.Fatalf("resumed Scan() returned %d keys, want %d", len(resumed), len(all)-mid)
+	}
+
+	for i, k := range resumed {
+		if k != all[mid+i] {
+			t.Fatalf("resumed Scan()[%d] = %q, want %q", i, k, all[mid+i])
+		}
+	}
+}
+
+func TestRamDB_ScanFetchValuesAndStop(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Set("k:"+strconv.Itoa(i), "value-"+strconv.Itoa(i), -1); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	seen := 0
+
+	err = db.Scan(kvstore.ScannerOptions{
+		Prefix:      "k:",
+		FetchValues: true,
+		Handler: func(k, v string) bool {
+			seen++
+			if v == "" {
+				t.Fatalf("Scan() handler got empty value for %q with FetchValues=true", k)
+			}
+			return seen < 3
+		},
+	})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	if seen != 3 {
+		t.Fatalf("Scan() handler ran %d times, want 3 after it returned false", seen)
+	}
+}
+
+func TestRamDB_SetNX(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if ok, err := db.SetNX("k", "v1", -1); err != nil || !ok {
+		t.Fatalf("SetNX() = %v, %v, want true, nil for a missing key", ok, err)
+	}
+
+	if ok, err := db.SetNX("k", "v2", -1); err != nil || ok {
+		t.Fatalf("SetNX() = %v, %v, want false, nil for an existing key", ok, err)
+	}
+
+	if v, _ := db.Get("k"); v != "v1" {
+		t.Fatalf("Get() = %q, want %q after a rejected SetNX()", v, "v1")
+	}
+}
+
+func TestRamDB_SetXX(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if ok, err := db.SetXX("k", "v1", -1); err != nil || ok {
+		t.Fatalf("SetXX() = %v, %v, want false, nil for a missing key", ok, err)
+	}
+
+	if err := db.Set("k", "v0", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if ok, err := db.SetXX("k", "v1", -1); err != nil || !ok {
+		t.Fatalf("SetXX() = %v, %v, want true, nil for an existing key", ok, err)
+	}
+
+	if v, _ := db.Get("k"); v != "v1" {
+		t.Fatalf("Get() = %q, want %q after a successful SetXX()", v, "v1")
+	}
+}
+
+func TestRamDB_CAS(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Set("k", "old", -1); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if ok, err := db.CAS("k", "wrong", "new", -1); err != nil || ok {
+		t.Fatalf("CAS() = %v, %v, want false, nil for a mismatched old value", ok, err)
+	}
+
+	if ok, err := db.CAS("k", "old", "new", -1); err != nil || !ok {
+		t.Fatalf("CAS() = %v, %v, want true, nil for a matching old value", ok, err)
+	}
+
+	if v, _ := db.Get("k"); v != "new" {
+		t.Fatalf("Get() = %q, want %q after a successful CAS()", v, "new")
+	}
+}
+
+func TestRamDB_GetSet(t *testing.T) {
+	db, err := OpenRam("")
+	if err != nil {
+		t.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	if old, err := db.GetSet("k", "v1", -1); err != nil || old != "" {
+		t.Fatalf("GetSet() = %q, %v, want \"\", nil for a missing key", old, err)
+	}
+
+	if old, err := db.GetSet("k", "v2", -1); err != nil || old != "v1" {
+		t.Fatalf("GetSet() = %q, %v, want %q, nil", old, err, "v1")
+	}
+
+	if v, _ := db.Get("k"); v != "v2" {
+		t.Fatalf("Get() = %q, want %q after GetSet()", v, "v2")
+	}
+}
+
+func BenchmarkRamSetGet(b *testing.B) {
+	db, err := OpenRam("")
+	if err != nil {
+		b.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		k := "key:" + strconv.Itoa(i)
+		db.Set(k, "value", -1)
+		db.Get(k)
+	}
+}
+
+func BenchmarkRamParallel(b *testing.B) {
+	db, err := OpenRam("")
+	if err != nil {
+		b.Fatalf("OpenRam() error = %v", err)
+	}
+	defer db.Close()
+
+	b.ReportAllocs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := "key:" + strconv.Itoa(i%1000)
+			db.Set(k, "value", -1)
+			db.Get(k)
+			i++
+		}
+	})
+}